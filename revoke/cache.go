@@ -0,0 +1,312 @@
+package revoke
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// defaultCacheEntries bounds the number of CRLs the default in-memory
+// cache holds at once.
+const defaultCacheEntries = 256
+
+// Cache is the interface that CRL caches used by Revoke must
+// implement. It replaces the unbounded map that Revoke previously
+// kept, allowing callers to bound memory use (an LRU) or persist
+// fetched CRLs across restarts (a filesystem-backed cache).
+type Cache interface {
+	// Add stores value under key, evicting an older entry if
+	// necessary. It reports whether the value was stored.
+	Add(key string, value *x509.RevocationList) bool
+	// Get returns the value stored under key, and whether it was
+	// found.
+	Get(key string) (value *x509.RevocationList, ok bool)
+}
+
+// lruCache is a Cache bounded to a fixed number of entries, evicting
+// the least recently used entry once that bound is exceeded.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value *x509.RevocationList
+}
+
+// NewLRUCache returns a Cache that holds at most maxEntries CRLs,
+// evicting the least recently used entry on overflow. A non-positive
+// maxEntries falls back to defaultCacheEntries.
+func NewLRUCache(maxEntries int) Cache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	return &lruCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) Add(key string, value *x509.RevocationList) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*lruEntry).value = value
+		return true
+	}
+
+	el := c.ll.PushFront(&lruEntry{key: key, value: value})
+	c.items[key] = el
+
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+
+	return true
+}
+
+func (c *lruCache) Get(key string) (*x509.RevocationList, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+// remoteIssuerEntry is one entry in a remoteIssuerCache.
+type remoteIssuerEntry struct {
+	key    string
+	issuer *x509.Certificate
+}
+
+// remoteIssuerCache bounds how many remote CRL issuer certificates
+// Revoke remembers (see Revoke.remoteCRLIssuers), evicting the least
+// recently used entry once that bound is exceeded, the same way
+// lruCache bounds the CRLs themselves, so this bookkeeping can't grow
+// without bound over the life of a long-running process.
+type remoteIssuerCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+// newRemoteIssuerCache returns a remoteIssuerCache bounded to
+// maxEntries. A non-positive maxEntries falls back to
+// defaultCacheEntries.
+func newRemoteIssuerCache(maxEntries int) *remoteIssuerCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	return &remoteIssuerCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+// set records issuer as the one used to verify the remote CRL at key,
+// evicting the least recently used entry if this pushes the cache
+// over its bound.
+func (c *remoteIssuerCache) set(key string, issuer *x509.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*remoteIssuerEntry).issuer = issuer
+		return
+	}
+
+	el := c.ll.PushFront(&remoteIssuerEntry{key: key, issuer: issuer})
+	c.items[key] = el
+
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*remoteIssuerEntry).key)
+	}
+}
+
+// keys returns a snapshot of the cache keys currently tracked, for
+// callers that need to iterate them (for example refreshRemoteCRLs).
+func (c *remoteIssuerCache) keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// get returns the issuer certificate recorded for key, and whether
+// one was found.
+func (c *remoteIssuerCache) get(key string) (*x509.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*remoteIssuerEntry).issuer, true
+}
+
+// FileCache is a Cache that persists fetched CRLs under a directory
+// on disk, in addition to keeping an LRU-bounded in-memory copy. CRLs
+// are stored in files named after the SHA-1 of their cache key (the
+// CRL DP URL, or a caller-chosen issuer+CRLNumber key), so that
+// revocation checks survive process restarts without growing memory
+// use without bound.
+type FileCache struct {
+	dir string
+	mem Cache
+}
+
+// NewFileCache returns a FileCache rooted at dir, creating it if
+// necessary. On startup it scans dir and loads every CRL that parses
+// and hasn't expired into the in-memory cache, keyed by its stored
+// hash; expired CRLs are removed from disk.
+func NewFileCache(dir string, maxEntries int) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	fc := &FileCache{
+		dir: dir,
+		mem: NewLRUCache(maxEntries),
+	}
+
+	if err := fc.warm(); err != nil {
+		return nil, err
+	}
+
+	return fc, nil
+}
+
+func (fc *FileCache) path(hash string) string {
+	return filepath.Join(fc.dir, hash+".crl")
+}
+
+func hashCacheKey(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// warm scans fc.dir and loads every valid, unexpired CRL it finds
+// into the in-memory cache, so that a restarted process doesn't
+// re-fetch CRLs it already has on disk.
+func (fc *FileCache) warm() error {
+	entries, err := ioutil.ReadDir(fc.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".crl" {
+			continue
+		}
+
+		hash := entry.Name()[:len(entry.Name())-len(".crl")]
+		crl, err := fc.readFromDisk(hash)
+		if err != nil {
+			log.Warningf("skipping unreadable cached CRL %s: %v", entry.Name(), err)
+			continue
+		}
+		if crl == nil {
+			continue
+		}
+
+		fc.mem.Add(hash, crl)
+	}
+
+	return nil
+}
+
+// readFromDisk reads and parses the CRL stored under hash, removing
+// it and returning (nil, nil) if it has expired.
+func (fc *FileCache) readFromDisk(hash string) (*x509.RevocationList, error) {
+	data, err := ioutil.ReadFile(fc.path(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if isCRLExpired(crl) {
+		os.Remove(fc.path(hash))
+		return nil, nil
+	}
+
+	return crl, nil
+}
+
+func (fc *FileCache) Get(key string) (*x509.RevocationList, bool) {
+	hash := hashCacheKey(key)
+
+	if crl, ok := fc.mem.Get(hash); ok {
+		return crl, true
+	}
+
+	crl, err := fc.readFromDisk(hash)
+	if err != nil || crl == nil {
+		return nil, false
+	}
+
+	fc.mem.Add(hash, crl)
+	return crl, true
+}
+
+func (fc *FileCache) Add(key string, value *x509.RevocationList) bool {
+	hash := hashCacheKey(key)
+	fc.mem.Add(hash, value)
+
+	if err := ioutil.WriteFile(fc.path(hash), value.Raw, 0644); err != nil {
+		log.Warningf("failed to persist CRL to %s: %v", fc.dir, err)
+		return false
+	}
+
+	return true
+}
+
+// isCRLExpired reports whether crl is past its NextUpdate time. A CRL
+// with no NextUpdate is treated as never expiring, matching the
+// optional nature of that field in RFC 5280.
+func isCRLExpired(crl *x509.RevocationList) bool {
+	if crl.NextUpdate.IsZero() {
+		return false
+	}
+	return time.Now().After(crl.NextUpdate)
+}
@@ -0,0 +1,34 @@
+package revoke
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+// TestRemoteIssuerCache_Bounded confirms a remoteIssuerCache evicts
+// its least recently used entry once more than maxEntries distinct
+// keys are set, so it can't grow without bound.
+func TestRemoteIssuerCache_Bounded(t *testing.T) {
+	c := newRemoteIssuerCache(2)
+
+	issuerA := &x509.Certificate{}
+	issuerB := &x509.Certificate{}
+	issuerC := &x509.Certificate{}
+
+	c.set("a", issuerA)
+	c.set("b", issuerB)
+	c.set("c", issuerC)
+
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expected the least recently used entry to have been evicted")
+	}
+	if _, ok := c.get("b"); !ok {
+		t.Fatal("expected a still-live entry to remain cached")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatal("expected the most recently set entry to remain cached")
+	}
+	if got := len(c.keys()); got != 2 {
+		t.Fatalf("expected the cache to hold at most 2 entries, got %d", got)
+	}
+}
@@ -0,0 +1,196 @@
+package revoke
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// RFC 5280 CRL extension OIDs. oidExtensionCRLNumber isn't needed here
+// since x509.RevocationList already parses it into crl.Number.
+var (
+	oidExtensionIssuingDistributionPt = asn1.ObjectIdentifier{2, 5, 29, 28}
+	oidExtensionFreshestCRL           = asn1.ObjectIdentifier{2, 5, 29, 46}
+	oidExtensionDeltaCRLIndicator     = asn1.ObjectIdentifier{2, 5, 29, 27}
+)
+
+// distributionPointName and distributionPoint mirror the unexported
+// types crypto/x509 uses to parse the cRLDistributionPoints and
+// freshestCRL extensions (RFC 5280 §4.2.1.13/4.2.1.15); we need our
+// own copies to read the Freshest CRL extension on a CRL we've
+// already parsed.
+type distributionPointName struct {
+	FullName     []asn1.RawValue  `asn1:"optional,tag:0"`
+	RelativeName pkix.RDNSequence `asn1:"optional,tag:1"`
+}
+
+type distributionPoint struct {
+	DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+	Reason            asn1.BitString        `asn1:"optional,tag:1"`
+	CRLIssuer         asn1.RawValue         `asn1:"optional,tag:2"`
+}
+
+// issuingDistributionPoint is the RFC 5280 §5.2.5 IssuingDistributionPoint
+// CRL extension.
+type issuingDistributionPoint struct {
+	DistributionPoint          distributionPointName `asn1:"optional,tag:0"`
+	OnlyContainsUserCerts      bool                  `asn1:"optional,tag:1"`
+	OnlyContainsCACerts        bool                  `asn1:"optional,tag:2"`
+	OnlySomeReasons            asn1.BitString        `asn1:"optional,tag:3"`
+	IndirectCRL                bool                  `asn1:"optional,tag:4"`
+	OnlyContainsAttributeCerts bool                  `asn1:"optional,tag:5"`
+}
+
+// findExtension returns the extension with the given oid, or nil if
+// it isn't present.
+func findExtension(exts []pkix.Extension, oid asn1.ObjectIdentifier) *pkix.Extension {
+	for i := range exts {
+		if exts[i].Id.Equal(oid) {
+			return &exts[i]
+		}
+	}
+	return nil
+}
+
+// uriNames extracts the uniformResourceIdentifier GeneralNames (tag 6)
+// from a DistributionPointName's FullName.
+func uriNames(fullName []asn1.RawValue) []string {
+	var uris []string
+	for _, name := range fullName {
+		if name.Tag == 6 {
+			uris = append(uris, string(name.Bytes))
+		}
+	}
+	return uris
+}
+
+// deltaBaseCRLNumber parses the Delta CRL Indicator extension (OID
+// 2.5.29.27) that a delta CRL carries instead of a plain CRL Number,
+// identifying the base CRL it applies to.
+func deltaBaseCRLNumber(crl *x509.RevocationList) (*big.Int, error) {
+	ext := findExtension(crl.Extensions, oidExtensionDeltaCRLIndicator)
+	if ext == nil {
+		return nil, nil
+	}
+
+	number := new(big.Int)
+	if _, err := asn1.Unmarshal(ext.Value, &number); err != nil {
+		return nil, fmt.Errorf("failed to parse delta CRL indicator extension: %v", err)
+	}
+	return number, nil
+}
+
+// freshestCRLURLs parses the Freshest CRL extension (OID 2.5.29.46) on
+// a base CRL, returning the URLs of any delta CRL distribution
+// points.
+func freshestCRLURLs(crl *x509.RevocationList) ([]string, error) {
+	ext := findExtension(crl.Extensions, oidExtensionFreshestCRL)
+	if ext == nil {
+		return nil, nil
+	}
+
+	var points []distributionPoint
+	if _, err := asn1.Unmarshal(ext.Value, &points); err != nil {
+		return nil, fmt.Errorf("failed to parse freshest CRL extension: %v", err)
+	}
+
+	var urls []string
+	for _, point := range points {
+		urls = append(urls, uriNames(point.DistributionPoint.FullName)...)
+	}
+	return urls, nil
+}
+
+// checkIssuingDistributionPoint enforces RFC 5280 §5.2.5: a CRL
+// fetched from a particular distribution point URL must only be used
+// to check certificates that distribution point actually covers, and
+// a CRL scoped to only user or only CA certificates must not be used
+// to check the other kind. crlURL is the CRL distribution point URL
+// the CRL was fetched from; pass "" for a CRL read from a local file
+// or directory, where there's no CDP URL for the IDP's distribution
+// point name to be checked against, so that sub-check is skipped
+// while the user/CA-cert restrictions are still enforced. It returns
+// an error describing why crl is unusable for cert, or nil if it's
+// usable.
+func checkIssuingDistributionPoint(crl *x509.RevocationList, crlURL string, cert *x509.Certificate) error {
+	ext := findExtension(crl.Extensions, oidExtensionIssuingDistributionPt)
+	if ext == nil {
+		return nil
+	}
+
+	var idp issuingDistributionPoint
+	if _, err := asn1.Unmarshal(ext.Value, &idp); err != nil {
+		return fmt.Errorf("failed to parse issuing distribution point extension: %v", err)
+	}
+
+	if idp.OnlyContainsUserCerts && cert.IsCA {
+		return fmt.Errorf("CRL only contains user certificates, but %q is a CA certificate", cert.Subject.CommonName)
+	}
+	if idp.OnlyContainsCACerts && !cert.IsCA {
+		return fmt.Errorf("CRL only contains CA certificates, but %q is not a CA certificate", cert.Subject.CommonName)
+	}
+	if idp.OnlyContainsAttributeCerts {
+		return fmt.Errorf("CRL only contains attribute certificates")
+	}
+
+	if crlURL != "" {
+		if names := uriNames(idp.DistributionPoint.FullName); len(names) > 0 {
+			var matched bool
+			for _, name := range names {
+				if name == crlURL {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("certificate was not issued from the distribution point this CRL was issued for")
+			}
+		}
+	}
+
+	return nil
+}
+
+// reasonCodeRemoveFromCRL is the RFC 5280 §5.3.1 CRLReason value a
+// delta CRL entry carries to un-revoke a certificate that's still
+// listed on the cached base CRL, for example after a certificateHold
+// is lifted.
+const reasonCodeRemoveFromCRL = 8
+
+// mergeDelta returns a copy of base with delta's revoked certificate
+// entries merged in. delta must be a delta CRL whose Delta CRL
+// Indicator references base's CRL Number; callers are expected to
+// have already checked that with deltaBaseCRLNumber. A delta entry
+// for a serial number already on base replaces the base entry rather
+// than duplicating it, and a delta entry reporting reason
+// removeFromCRL removes that serial from the merged result instead of
+// being appended.
+func mergeDelta(base, delta *x509.RevocationList) *x509.RevocationList {
+	bySerial := map[string]x509.RevocationListEntry{}
+	for _, entry := range base.RevokedCertificateEntries {
+		bySerial[entry.SerialNumber.String()] = entry
+	}
+	for _, entry := range delta.RevokedCertificateEntries {
+		key := entry.SerialNumber.String()
+		if entry.ReasonCode == reasonCodeRemoveFromCRL {
+			delete(bySerial, key)
+			continue
+		}
+		bySerial[key] = entry
+	}
+
+	entries := make([]x509.RevocationListEntry, 0, len(bySerial))
+	for _, entry := range bySerial {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].SerialNumber.Cmp(entries[j].SerialNumber) < 0
+	})
+
+	merged := *base
+	merged.RevokedCertificateEntries = entries
+	return &merged
+}
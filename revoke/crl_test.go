@@ -0,0 +1,192 @@
+package revoke
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestIssuer returns a self-signed CA certificate and key usable as
+// the issuer of a test CRL.
+func newTestIssuer(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate test issuer key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create test issuer certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse test issuer certificate: %v", err)
+	}
+	return cert, key
+}
+
+// newTestCRL builds and parses a CRL signed by issuer/key, so tests
+// exercise the same x509.ParseRevocationList path production code
+// uses rather than hand-built structs.
+func newTestCRL(t *testing.T, issuer *x509.Certificate, key *ecdsa.PrivateKey, number int64, entries []x509.RevocationListEntry, extraExtensions []pkix.Extension) *x509.RevocationList {
+	t.Helper()
+
+	template := &x509.RevocationList{
+		Number:                    big.NewInt(number),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+		ExtraExtensions:           extraExtensions,
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, issuer, key)
+	if err != nil {
+		t.Fatalf("failed to create test CRL: %v", err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("failed to parse test CRL: %v", err)
+	}
+	return crl
+}
+
+// idpExtension builds a pkix.Extension carrying an RFC 5280 §5.2.5
+// Issuing Distribution Point extension with the given restrictions.
+func idpExtension(t *testing.T, uris []string, onlyUserCerts, onlyCACerts bool) pkix.Extension {
+	t.Helper()
+
+	idp := issuingDistributionPoint{
+		OnlyContainsUserCerts: onlyUserCerts,
+		OnlyContainsCACerts:   onlyCACerts,
+	}
+	for _, uri := range uris {
+		idp.DistributionPoint.FullName = append(idp.DistributionPoint.FullName, asn1.RawValue{
+			Class: asn1.ClassContextSpecific,
+			Tag:   6,
+			Bytes: []byte(uri),
+		})
+	}
+
+	der, err := asn1.Marshal(idp)
+	if err != nil {
+		t.Fatalf("failed to marshal test IDP extension: %v", err)
+	}
+	return pkix.Extension{Id: oidExtensionIssuingDistributionPt, Value: der}
+}
+
+func TestCheckIssuingDistributionPoint(t *testing.T) {
+	issuer, key := newTestIssuer(t)
+	const cdpURL = "http://ca.example.com/ca.crl"
+
+	t.Run("accepts matching CDP URL", func(t *testing.T) {
+		crl := newTestCRL(t, issuer, key, 1, nil, []pkix.Extension{idpExtension(t, []string{cdpURL}, false, false)})
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}}
+		if err := checkIssuingDistributionPoint(crl, cdpURL, cert); err != nil {
+			t.Fatalf("expected matching CDP URL to be accepted: %v", err)
+		}
+	})
+
+	t.Run("rejects mismatched CDP URL", func(t *testing.T) {
+		crl := newTestCRL(t, issuer, key, 2, nil, []pkix.Extension{idpExtension(t, []string{cdpURL}, false, false)})
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}}
+		if err := checkIssuingDistributionPoint(crl, "http://other.example.com/ca.crl", cert); err == nil {
+			t.Fatal("expected mismatched CDP URL to be rejected")
+		}
+	})
+
+	t.Run("skips CDP URL check for local CRLs", func(t *testing.T) {
+		crl := newTestCRL(t, issuer, key, 3, nil, []pkix.Extension{idpExtension(t, []string{cdpURL}, false, false)})
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}}
+		if err := checkIssuingDistributionPoint(crl, "", cert); err != nil {
+			t.Fatalf("expected a local CRL (crlURL=\"\") to skip the distribution point name check: %v", err)
+		}
+	})
+
+	t.Run("rejects CA certificate against a user-certs-only CRL", func(t *testing.T) {
+		crl := newTestCRL(t, issuer, key, 4, nil, []pkix.Extension{idpExtension(t, nil, true, false)})
+		cert := &x509.Certificate{IsCA: true, Subject: pkix.Name{CommonName: "intermediate"}}
+		if err := checkIssuingDistributionPoint(crl, "", cert); err == nil {
+			t.Fatal("expected CA certificate to be rejected against a user-certs-only CRL")
+		}
+	})
+
+	t.Run("accepts CRL without an IDP extension", func(t *testing.T) {
+		crl := newTestCRL(t, issuer, key, 5, nil, nil)
+		cert := &x509.Certificate{IsCA: true, Subject: pkix.Name{CommonName: "intermediate"}}
+		if err := checkIssuingDistributionPoint(crl, "anything", cert); err != nil {
+			t.Fatalf("expected a CRL without an IDP extension to impose no restriction: %v", err)
+		}
+	})
+}
+
+func TestMergeDelta(t *testing.T) {
+	base := &x509.RevocationList{
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(1), ReasonCode: 1}, // keyCompromise, untouched by delta
+			{SerialNumber: big.NewInt(2), ReasonCode: 6}, // certificateHold, lifted by delta
+		},
+	}
+	delta := &x509.RevocationList{
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(2), ReasonCode: reasonCodeRemoveFromCRL},
+			{SerialNumber: big.NewInt(3), ReasonCode: 1}, // newly revoked by delta
+		},
+	}
+
+	merged := mergeDelta(base, delta)
+
+	bySerial := map[string]x509.RevocationListEntry{}
+	for _, entry := range merged.RevokedCertificateEntries {
+		bySerial[entry.SerialNumber.String()] = entry
+	}
+
+	if _, revoked := bySerial["2"]; revoked {
+		t.Fatal("expected serial 2 to be un-revoked by the delta's removeFromCRL entry")
+	}
+	if _, revoked := bySerial["1"]; !revoked {
+		t.Fatal("expected serial 1 (untouched by the delta) to remain revoked")
+	}
+	if _, revoked := bySerial["3"]; !revoked {
+		t.Fatal("expected serial 3 (newly revoked by the delta) to be present")
+	}
+	if len(merged.RevokedCertificateEntries) != 2 {
+		t.Fatalf("expected 2 revoked entries after merge, got %d", len(merged.RevokedCertificateEntries))
+	}
+}
+
+func TestMergeDelta_ReplacesBaseEntry(t *testing.T) {
+	base := &x509.RevocationList{
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(1), ReasonCode: 6}, // certificateHold
+		},
+	}
+	delta := &x509.RevocationList{
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(1), ReasonCode: 1}, // keyCompromise
+		},
+	}
+
+	merged := mergeDelta(base, delta)
+	if len(merged.RevokedCertificateEntries) != 1 {
+		t.Fatalf("expected the delta entry to replace the base entry for the same serial, got %d entries", len(merged.RevokedCertificateEntries))
+	}
+	if got := merged.RevokedCertificateEntries[0].ReasonCode; got != 1 {
+		t.Fatalf("expected the merged entry to carry the delta's reason code, got %d", got)
+	}
+}
@@ -5,16 +5,21 @@ package revoke
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	neturl "net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,15 +37,101 @@ type Revoke struct {
 	// will be checked only using local CRL script, remote methods will be
 	// skipped.
 	localCRL string
+	// localCRLDir is the directory or glob pattern passed to
+	// SetLocalCRL when it names more than one CRL file. It's mutually
+	// exclusive with localCRL.
+	localCRLDir string
+	// localCRLsByIssuer indexes the CRLs loaded from localCRLDir by
+	// the issuer key (see crlIssuerKey) of the CA that issued them, so
+	// a certificate is matched to its CRL by issuer rather than by
+	// the name of the file it came from.
+	localCRLsByIssuer map[string]*x509.RevocationList
+	// localCRLFileModTimes tracks the last-seen mtime of each file
+	// under localCRLDir, so refreshLocalCRLDir only re-parses files
+	// that changed since the last load.
+	localCRLFileModTimes map[string]time.Time
+	// localCRLFileIssuer tracks which issuer key each file under
+	// localCRLDir was last parsed into, so refreshLocalCRLDir can
+	// reuse the parsed CRL for an unchanged file without re-reading
+	// it.
+	localCRLFileIssuer map[string]string
+	// remoteCRLIssuers tracks the issuer certificate used to verify
+	// each remote CRL URL Revoke has successfully fetched, so
+	// StartRefresher can re-fetch it later without needing a fresh
+	// revocation check to supply the issuer again. It's bounded the
+	// same way the CRL cache itself is, so it can't grow without
+	// bound across the life of a long-running process.
+	remoteCRLIssuers *remoteIssuerCache
+	// refreshSkew is how far ahead of a remote CRL's NextUpdate
+	// StartRefresher re-fetches it.
+	refreshSkew time.Duration
 	// HardFail determines whether the failure to check the revocation
 	// status of a certificate (i.e. due to network failure) causes
 	// verification to fail (a hard failure).
 	hardFail bool
-	// crlSet associates a PKIX certificate list with the URL the CRL is
-	// fetched from.
-	crlSet map[string]*pkix.CertificateList
+	// cache associates a parsed RevocationList with the URL the CRL is
+	// fetched from. It defaults to an LRU cache so a long-running
+	// process doesn't grow this without bound; callers can swap in a
+	// disk-backed FileCache via SetCache.
+	cache Cache
+	// crlNumbers tracks the highest CRL Number extension value seen
+	// for each cache key, so a replayed or stale CRL with a lower
+	// number can't roll back an already-cached one.
+	crlNumbers map[string]*big.Int
+	// OCSPFallbackToCRL determines whether a failed or inconclusive
+	// OCSP check (a network/protocol error, or an "unknown" responder
+	// status) falls back to checking the CRL instead of being treated
+	// as an OCSP check failure. Under PolicyAllMustAgree it relaxes
+	// the "every endpoint must agree" requirement to tolerate an
+	// unreachable OCSP endpoint as long as some other endpoint gives a
+	// definitive answer. Defaults to false, preserving the behavior of
+	// treating OCSP failures as failures.
+	OCSPFallbackToCRL bool
+	// concurrency bounds how many of a certificate's CRL/OCSP
+	// endpoints are queried at once.
+	concurrency int
+	// endpointTimeout bounds how long a single CRL/OCSP endpoint is
+	// given to answer before it's treated as unreachable.
+	endpointTimeout time.Duration
+	// policy determines how results from multiple endpoints are
+	// combined into a single revoked/ok answer.
+	policy RevocationPolicy
 }
 
+// RevocationPolicy controls how revCheck combines the results of
+// concurrently-queried CRL/OCSP endpoints for a single certificate.
+type RevocationPolicy int
+
+const (
+	// PolicyAllMustAgree requires every queried endpoint to answer
+	// "not revoked" before the certificate is accepted; an endpoint
+	// that's unreachable fails the check unless OCSPFallbackToCRL
+	// tolerates it. This is the default (and the zero value), matching
+	// the fail-closed behavior of consulting every CRL/OCSP source
+	// before accepting a certificate.
+	PolicyAllMustAgree RevocationPolicy = iota
+	// PolicyAnyGood accepts the first definitive "not revoked" answer
+	// from any endpoint, canceling the rest still in flight. This
+	// minimizes latency, but a still-running endpoint that would have
+	// reported "revoked" is never given the chance to, so it must be
+	// opted into explicitly via SetPolicy rather than assumed safe by
+	// default.
+	PolicyAnyGood
+)
+
+const (
+	// defaultConcurrency bounds how many endpoints a Revoke queries
+	// at once when SetConcurrency hasn't been called.
+	defaultConcurrency = 8
+	// defaultEndpointTimeout bounds how long a single endpoint is
+	// given to answer when SetEndpointTimeout hasn't been called.
+	defaultEndpointTimeout = 10 * time.Second
+	// defaultRefreshSkew is how far ahead of a remote CRL's
+	// NextUpdate StartRefresher re-fetches it when SetRefreshSkew
+	// hasn't been called.
+	defaultRefreshSkew = time.Hour
+)
+
 // defaultChecker is a default config for regular apps which don't need to
 // use custom options.
 var defaultChecker = New(false)
@@ -49,31 +140,255 @@ var defaultChecker = New(false)
 // Accepts hardfail bool variable as an option
 func New(hardfail bool) *Revoke {
 	return &Revoke{
-		localCRL: "",
-		hardFail: hardfail,
-		crlSet:   map[string]*pkix.CertificateList{},
+		localCRL:             "",
+		hardFail:             hardfail,
+		cache:                NewLRUCache(defaultCacheEntries),
+		crlNumbers:           map[string]*big.Int{},
+		localCRLsByIssuer:    map[string]*x509.RevocationList{},
+		localCRLFileModTimes: map[string]time.Time{},
+		localCRLFileIssuer:   map[string]string{},
+		remoteCRLIssuers:     newRemoteIssuerCache(defaultCacheEntries),
+		refreshSkew:          defaultRefreshSkew,
+		concurrency:          defaultConcurrency,
+		endpointTimeout:      defaultEndpointTimeout,
+		policy:               PolicyAllMustAgree,
 	}
 }
 
-// SetLocalCRL sets localCRL path into the Revoke struct
+// SetCache replaces the CRL cache used by r, for example with a
+// FileCache so fetched CRLs survive process restarts.
+func (r *Revoke) SetCache(c Cache) {
+	r.lock.Lock()
+	r.cache = c
+	r.lock.Unlock()
+}
+
+// getCache returns the current CRL cache under lock, since SetCache
+// may swap it out concurrently with a revocation check.
+func (r *Revoke) getCache() Cache {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.cache
+}
+
+// SetLocalCRL sets localCRL path into the Revoke struct. localCRLpath
+// may also name a directory or a glob pattern (for example
+// "/etc/pki/crl/*.crl"), in which case every *.crl/*.pem file it
+// matches is loaded as an independent CRL, keyed by the Subject and
+// Authority Key Identifier of the CA that issued it; a certificate
+// under check is then matched to the right CRL by its issuer rather
+// than by which file that CRL happened to live in.
 func (r *Revoke) SetLocalCRL(localCRLpath string) error {
 	if localCRLpath == "" {
 		r.lock.Lock()
-		delete(r.crlSet, r.localCRL)
 		r.localCRL = ""
+		r.localCRLDir = ""
+		r.localCRLsByIssuer = map[string]*x509.RevocationList{}
+		r.localCRLFileModTimes = map[string]time.Time{}
+		r.localCRLFileIssuer = map[string]string{}
 		r.lock.Unlock()
 		return nil
 	}
 
-	if u, err := neturl.Parse(localCRLpath); err != nil {
+	u, err := neturl.Parse(localCRLpath)
+	if err != nil {
+		return err
+	}
+
+	path := localCRLpath
+	if u.Scheme == "file" {
+		path = u.Path
+	} else if u.Scheme != "" {
+		return fmt.Errorf("Path is not valid: %s", localCRLpath)
+	}
+
+	if looksLikeCRLGlob(path) {
+		return r.loadLocalCRLDir(path)
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return r.loadLocalCRLDir(path)
+	}
+
+	if err := r.fetchLocalCRL(path, true); err != nil {
 		return err
-	} else if u.Scheme == "" {
-		return r.fetchLocalCRL(localCRLpath, true)
-	} else if u.Scheme == "file" {
-		return r.fetchLocalCRL(u.Path, true)
+	}
+	r.lock.Lock()
+	r.localCRLDir = ""
+	r.lock.Unlock()
+	return nil
+}
+
+// looksLikeCRLGlob reports whether path contains glob metacharacters,
+// as opposed to naming a single file or directory outright.
+func looksLikeCRLGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// crlIssuerKey identifies the CA that issued a CRL or certificate by
+// its Subject DN and Authority Key Identifier, so a directory of CRLs
+// loaded by SetLocalCRL can be matched against a certificate by
+// issuer instead of by filename.
+func crlIssuerKey(issuer pkix.Name, authorityKeyID []byte) string {
+	return issuer.String() + "|" + hex.EncodeToString(authorityKeyID)
+}
+
+// localCRLFilesFor lists the files SetLocalCRL should load for path:
+// the glob's matches if path is a glob pattern, otherwise every
+// *.crl/*.pem file directly inside the directory path.
+func localCRLFilesFor(path string) ([]string, error) {
+	if looksLikeCRLGlob(path) {
+		return filepath.Glob(path)
+	}
+
+	var files []string
+	for _, pattern := range []string{"*.crl", "*.pem"} {
+		matches, err := filepath.Glob(filepath.Join(path, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// readLocalCRLFile reads and parses the CRL stored at path, which may
+// be either DER-encoded or PEM-encoded.
+func readLocalCRLFile(path string) (*x509.RevocationList, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return crl, info.ModTime(), nil
+}
+
+// loadLocalCRLDir points r at the directory or glob pattern path,
+// doing an initial load of every CRL file it matches.
+func (r *Revoke) loadLocalCRLDir(path string) error {
+	r.lock.Lock()
+	r.localCRL = ""
+	r.localCRLDir = path
+	r.localCRLsByIssuer = map[string]*x509.RevocationList{}
+	r.localCRLFileModTimes = map[string]time.Time{}
+	r.localCRLFileIssuer = map[string]string{}
+	r.lock.Unlock()
+
+	r.refreshLocalCRLDir()
+
+	r.lock.Lock()
+	n := len(r.localCRLsByIssuer)
+	r.lock.Unlock()
+	if n == 0 {
+		return fmt.Errorf("no usable CRL files found in %s", path)
+	}
+	return nil
+}
+
+// refreshLocalCRLDir re-scans r's local CRL directory, re-parsing
+// only the files whose mtime changed since the last scan and reusing
+// the already-parsed CRL for everything else. It's a no-op if
+// SetLocalCRL hasn't been pointed at a directory.
+func (r *Revoke) refreshLocalCRLDir() {
+	r.lock.Lock()
+	dir := r.localCRLDir
+	prevModTimes := r.localCRLFileModTimes
+	prevByIssuer := r.localCRLsByIssuer
+	prevFileIssuer := r.localCRLFileIssuer
+	r.lock.Unlock()
+
+	if dir == "" {
+		return
+	}
+
+	files, err := localCRLFilesFor(dir)
+	if err != nil {
+		log.Warningf("failed to list local CRL directory %s: %v", dir, err)
+		return
+	}
+
+	byIssuer := map[string]*x509.RevocationList{}
+	modTimes := map[string]time.Time{}
+	fileIssuer := map[string]string{}
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Warningf("skipping unreadable local CRL %s: %v", file, err)
+			continue
+		}
+
+		if prevModTime, ok := prevModTimes[file]; ok && info.ModTime().Equal(prevModTime) {
+			key := prevFileIssuer[file]
+			byIssuer[key] = prevByIssuer[key]
+			modTimes[file] = prevModTime
+			fileIssuer[file] = key
+			continue
+		}
+
+		crl, modTime, err := readLocalCRLFile(file)
+		if err != nil {
+			log.Warningf("skipping unreadable local CRL %s: %v", file, err)
+			continue
+		}
+
+		key := crlIssuerKey(crl.Issuer, crl.AuthorityKeyId)
+		byIssuer[key] = crl
+		modTimes[file] = modTime
+		fileIssuer[file] = key
+	}
+
+	r.lock.Lock()
+	r.localCRLsByIssuer = byIssuer
+	r.localCRLFileModTimes = modTimes
+	r.localCRLFileIssuer = fileIssuer
+	r.lock.Unlock()
+}
+
+// lookupLocalCRLForIssuer returns the CRL loaded from r's local CRL
+// directory for cert's issuer, if any.
+func (r *Revoke) lookupLocalCRLForIssuer(cert *x509.Certificate) (*x509.RevocationList, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	crl, ok := r.localCRLsByIssuer[crlIssuerKey(cert.Issuer, cert.AuthorityKeyId)]
+	return crl, ok
+}
+
+// checkLocalRevocationList checks cert's serial number against an
+// already-loaded CRL from r's local CRL directory, enforcing the same
+// RFC 5280 issuing distribution point restrictions as the remote and
+// single-file local CRL paths (see checkIssuingDistributionPoint).
+func checkLocalRevocationList(crl *x509.RevocationList, cert *x509.Certificate) (revoked, ok bool) {
+	if isCRLExpired(crl) {
+		log.Warningf("local CRL for issuer %q has expired", cert.Issuer.String())
+		return false, false
+	}
+
+	if err := checkIssuingDistributionPoint(crl, "", cert); err != nil {
+		log.Warningf("local CRL for issuer %q is not usable for this certificate: %v", cert.Issuer.String(), err)
+		return false, false
+	}
+
+	for _, entry := range crl.RevokedCertificateEntries {
+		if cert.SerialNumber.Cmp(entry.SerialNumber) == 0 {
+			return true, true
+		}
 	}
 
-	return fmt.Errorf("Path is not valid: %s", localCRLpath)
+	return false, true
 }
 
 // SetHardFail allows to dynamically set hardfail bool into the
@@ -102,6 +417,61 @@ func (r *Revoke) IsHardFail() bool {
 	return r.hardFail
 }
 
+// SetConcurrency bounds how many of a certificate's CRL/OCSP endpoints
+// r queries at once. A non-positive n falls back to
+// defaultConcurrency.
+func (r *Revoke) SetConcurrency(n int) {
+	if n <= 0 {
+		n = defaultConcurrency
+	}
+	r.lock.Lock()
+	r.concurrency = n
+	r.lock.Unlock()
+}
+
+// SetEndpointTimeout bounds how long r waits on a single CRL/OCSP
+// endpoint before treating it as unreachable. A non-positive d falls
+// back to defaultEndpointTimeout. The overall deadline for a
+// revocation check is still governed by the ctx passed to
+// VerifyCertificateContext.
+func (r *Revoke) SetEndpointTimeout(d time.Duration) {
+	if d <= 0 {
+		d = defaultEndpointTimeout
+	}
+	r.lock.Lock()
+	r.endpointTimeout = d
+	r.lock.Unlock()
+}
+
+// SetPolicy sets the policy r uses to combine results from a
+// certificate's multiple CRL/OCSP endpoints.
+func (r *Revoke) SetPolicy(p RevocationPolicy) {
+	r.lock.Lock()
+	r.policy = p
+	r.lock.Unlock()
+}
+
+// ocspStapleContextKey is the context.Value key under which a
+// caller-supplied stapled OCSP response is stored by WithOCSPStaple.
+type ocspStapleContextKey struct{}
+
+// WithOCSPStaple returns a copy of ctx carrying staple, a DER-encoded
+// OCSP response obtained via TLS stapling (for example
+// tls.ConnectionState.OCSPResponse). VerifyCertificateContext and
+// Revoke.VerifyCertificateContext verify cert against a stapled
+// response first, avoiding a network round-trip to an OCSP responder
+// or CRL distribution point when it's available and valid.
+func WithOCSPStaple(ctx context.Context, staple []byte) context.Context {
+	return context.WithValue(ctx, ocspStapleContextKey{}, staple)
+}
+
+// ocspStapleFromContext returns the stapled OCSP response stored in
+// ctx by WithOCSPStaple, if any.
+func ocspStapleFromContext(ctx context.Context) []byte {
+	staple, _ := ctx.Value(ocspStapleContextKey{}).([]byte)
+	return staple
+}
+
 // We can't handle LDAP certificates, so this checks to see if the
 // URL string points to an LDAP resource so that we can ignore it.
 func ldapURL(url string) bool {
@@ -131,13 +501,30 @@ func ldapURL(url string) bool {
 //
 //  true, false:  failure to check revocation status causes
 //                  verification to fail
-func (r *Revoke) revCheck(cert *x509.Certificate) (revoked, ok bool) {
+//
+// revCheck honors ctx's deadline and cancellation when making any
+// network requests required to perform the check.
+func (r *Revoke) revCheck(ctx context.Context, cert *x509.Certificate) (revoked, ok bool) {
 	r.lock.Lock()
 	localCRL := r.localCRL
+	hasLocalCRLDir := r.localCRLDir != ""
 	hardFail := r.hardFail
 	r.lock.Unlock()
+
+	if staple := ocspStapleFromContext(ctx); len(staple) > 0 {
+		if issuer := getIssuer(ctx, cert); issuer != nil {
+			if revoked, ok := VerifyStapledOCSP(cert, issuer, staple); ok {
+				if revoked {
+					log.Infof("certificate is revoked by stapled OCSP response (CN=%s, Serial: %s)", cert.Subject.CommonName, cert.SerialNumber)
+				}
+				return revoked, true
+			}
+			log.Warning("stapled OCSP response did not verify, falling back to CRL/OCSP checks")
+		}
+	}
+
 	if localCRL != "" {
-		if revoked, ok := r.certIsRevokedCRL(cert, localCRL, false); !ok {
+		if revoked, ok := r.certIsRevokedCRL(ctx, cert, localCRL, false, nil); !ok {
 			log.Warning("error checking revocation via local CRL file")
 			if hardFail {
 				return true, false
@@ -149,61 +536,210 @@ func (r *Revoke) revCheck(cert *x509.Certificate) (revoked, ok bool) {
 		}
 	}
 
+	if hasLocalCRLDir {
+		if crl, found := r.lookupLocalCRLForIssuer(cert); found {
+			if revoked, ok := checkLocalRevocationList(crl, cert); !ok {
+				log.Warning("error checking revocation via local CRL directory")
+				if hardFail {
+					return true, false
+				}
+				return false, false
+			} else if revoked {
+				log.Infof("certificate is revoked by local CRL directory (CN=%s, Serial: %s)", cert.Subject.CommonName, cert.SerialNumber)
+				return true, true
+			}
+		}
+	}
+
+	revoked, ok = r.checkEndpoints(ctx, cert)
+	if revoked {
+		log.Infof("certificate is revoked (CN=%s, Serial: %s)", cert.Subject.CommonName, cert.SerialNumber)
+		return true, true
+	}
+	if !ok {
+		log.Warning("error checking revocation via CRL/OCSP endpoints")
+		if hardFail {
+			return true, false
+		}
+		return false, false
+	}
+
+	return false, true
+}
+
+// endpointCheck is one CRL or OCSP endpoint revCheck can query, bound
+// to a specific certificate and issuer.
+type endpointCheck struct {
+	label string
+	ocsp  bool
+	run   func(ctx context.Context) (revoked, ok bool)
+}
+
+// checkEndpoints queries every CRL distribution point and OCSP
+// responder listed on cert concurrently, modeled after an
+// errgroup-style coordinator: a shared context is canceled as soon as
+// a definitive answer makes the rest of the endpoints moot, and a
+// semaphore bounds how many run at once. Each endpoint gets its own
+// timeout derived from r's endpointTimeout, in addition to whatever
+// deadline ctx already carries.
+func (r *Revoke) checkEndpoints(ctx context.Context, cert *x509.Certificate) (revoked, ok bool) {
+	issuer := getIssuer(ctx, cert)
+
+	var checks []endpointCheck
 	for _, url := range cert.CRLDistributionPoints {
 		if ldapURL(url) {
 			log.Infof("skipping LDAP CRL: %s", url)
 			continue
 		}
+		url := url
+		checks = append(checks, endpointCheck{
+			label: fmt.Sprintf("CRL %s", url),
+			run: func(ctx context.Context) (revoked, ok bool) {
+				return r.certIsRevokedCRL(ctx, cert, url, true, issuer)
+			},
+		})
+	}
 
-		if revoked, ok := r.certIsRevokedCRL(cert, url, true); !ok {
-			log.Warning("error checking revocation via CRL")
-			if hardFail {
-				return true, false
+	if issuer != nil && len(cert.OCSPServer) > 0 {
+		ocspRequest, err := ocsp.CreateRequest(cert, issuer, &ocspOpts)
+		if err != nil {
+			log.Warningf("failed to build OCSP request: %v", err)
+		} else {
+			for _, server := range cert.OCSPServer {
+				server := server
+				checks = append(checks, endpointCheck{
+					label: fmt.Sprintf("OCSP %s", server),
+					ocsp:  true,
+					run: func(ctx context.Context) (revoked, ok bool) {
+						return checkOCSPResponder(ctx, server, ocspRequest, issuer)
+					},
+				})
 			}
-			return false, false
-		} else if revoked {
-			log.Infof("certificate is revoked by '%s' CRL (CN=%s, Serial: %s)", url, cert.Subject.CommonName, cert.SerialNumber)
-			return true, true
 		}
+	}
 
-		if revoked, ok := certIsRevokedOCSP(cert, hardFail); !ok {
-			log.Warning("error checking revocation via OCSP")
-			if hardFail {
-				return true, false
+	if len(checks) == 0 {
+		return false, true
+	}
+
+	return r.runEndpointChecks(ctx, checks)
+}
+
+// runEndpointChecks runs checks concurrently, bounded by r's
+// concurrency and endpointTimeout, and combines their results
+// according to r's policy. A definitive "revoked" from any endpoint
+// always short-circuits and cancels the rest. Under PolicyAnyGood, a
+// definitive "not revoked" does too; under PolicyAllMustAgree every
+// endpoint must answer "not revoked" (unless OCSPFallbackToCRL
+// tolerates the OCSP responders that didn't; a failed CRL endpoint is
+// never tolerated).
+func (r *Revoke) runEndpointChecks(ctx context.Context, checks []endpointCheck) (revoked, ok bool) {
+	r.lock.Lock()
+	concurrency := r.concurrency
+	endpointTimeout := r.endpointTimeout
+	policy := r.policy
+	tolerateFailures := r.OCSPFallbackToCRL
+	r.lock.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		revoked, ok, ocsp bool
+	}
+
+	sem := make(chan struct{}, concurrency)
+	results := make(chan result, len(checks))
+
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
 			}
-			return false, false
-		} else if revoked {
-			log.Infof("certificate is revoked by '%s' OCSP (CN=%s, Serial: %s)", url, cert.Subject.CommonName, cert.SerialNumber)
+			defer func() { <-sem }()
+
+			endCtx, endCancel := context.WithTimeout(ctx, endpointTimeout)
+			defer endCancel()
+
+			revoked, ok := c.run(endCtx)
+			if !ok {
+				log.Warningf("error checking revocation via %s", c.label)
+			}
+
+			select {
+			case results <- result{revoked, ok, c.ocsp}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var anyOK, anyFailed bool
+	for res := range results {
+		if !res.ok {
+			if !(tolerateFailures && res.ocsp) {
+				anyFailed = true
+			}
+			continue
+		}
+		anyOK = true
+		if res.revoked {
+			cancel()
 			return true, true
 		}
+		if policy == PolicyAnyGood {
+			cancel()
+			return false, true
+		}
 	}
 
-	return false, true
+	if policy == PolicyAllMustAgree && anyFailed {
+		return false, false
+	}
+	return false, anyOK
 }
 
-// fetchCRL fetches and parses a CRL.
-func fetchCRL(url string) (*pkix.CertificateList, error) {
-	resp, err := http.Get(url)
+// fetchCRL fetches and parses a CRL, honoring ctx's deadline and
+// cancellation for the underlying HTTP request.
+func fetchCRL(ctx context.Context, url string) (*x509.RevocationList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	} else if resp.StatusCode >= 300 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("failed to retrieve CRL")
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		resp.Body.Close()
 		return nil, err
 	}
 	resp.Body.Close()
 
-	return x509.ParseCRL(body)
+	return x509.ParseRevocationList(body)
 }
 
-func getIssuer(cert *x509.Certificate) *x509.Certificate {
+func getIssuer(ctx context.Context, cert *x509.Certificate) *x509.Certificate {
 	var issuer *x509.Certificate
 	var err error
 	for _, issuingCert := range cert.IssuingCertificateURL {
-		issuer, err = fetchRemote(issuingCert)
+		issuer, err = fetchRemote(ctx, issuingCert)
 		if err != nil {
 			continue
 		}
@@ -215,22 +751,12 @@ func getIssuer(cert *x509.Certificate) *x509.Certificate {
 
 // checks whether CRL in memory is valid
 func (r *Revoke) isInMemoryCRLValid(key string) bool {
-	defer r.lock.Unlock()
-	r.lock.Lock()
-	crl, ok := r.crlSet[key]
-	if ok && crl == nil {
-		ok = false
-		delete(r.crlSet, key)
-	} else if crl == nil {
-		delete(r.crlSet, key)
+	crl, ok := r.getCache().Get(key)
+	if !ok || crl == nil {
 		return false
 	}
 
-	if ok && !crl.HasExpired(time.Now()) {
-		return true
-	}
-
-	return false
+	return !isCRLExpired(crl)
 }
 
 // fetchLocalCRL reads CRL from the local filesystem
@@ -245,7 +771,7 @@ func (r *Revoke) fetchLocalCRL(newLocalCRL string, force bool) error {
 		if err != nil {
 			return fmt.Errorf("failed to read local CRL path: %v", err)
 		}
-		crl, err := x509.ParseCRL(tmp)
+		crl, err := x509.ParseRevocationList(tmp)
 		if err != nil {
 			return fmt.Errorf("failed to parse local CRL file: %v", err)
 		}
@@ -254,12 +780,9 @@ func (r *Revoke) fetchLocalCRL(newLocalCRL string, force bool) error {
 			return fmt.Errorf("CRL is nil")
 		}
 
+		r.getCache().Add(newLocalCRL, crl)
 		r.lock.Lock()
-		r.crlSet[newLocalCRL] = crl
-		if r.localCRL != newLocalCRL {
-			delete(r.crlSet, r.localCRL)
-			r.localCRL = newLocalCRL
-		}
+		r.localCRL = newLocalCRL
 		r.lock.Unlock()
 	}
 
@@ -269,36 +792,225 @@ func (r *Revoke) fetchLocalCRL(newLocalCRL string, force bool) error {
 // FetchRemoteCRL fetches remote CRL into internal map,
 // force overwrites previously read CRL
 func (r *Revoke) FetchRemoteCRL(url string, issuer *x509.Certificate, force bool) error {
+	return r.FetchRemoteCRLContext(context.Background(), url, issuer, force)
+}
+
+// GetCachedRevocationList returns the parsed *x509.RevocationList that
+// was fetched for key (a CRL distribution point URL, or a local CRL
+// path passed to SetLocalCRL), if one is cached. It's the supported
+// way for callers to inspect RFC 5280 fields such as Number,
+// NextUpdate, or RevokedCertificateEntries now that Revoke no longer
+// deals in the deprecated pkix.CertificateList.
+func (r *Revoke) GetCachedRevocationList(key string) (*x509.RevocationList, bool) {
+	return r.getCache().Get(key)
+}
+
+// FetchRemoteCRLContext fetches remote CRL into internal map, force
+// overwrites previously read CRL. It honors ctx's deadline and
+// cancellation for the underlying HTTP request, so callers bounding
+// revocation lookups (for example during a TLS handshake) don't block
+// indefinitely on a stalled CDP.
+func (r *Revoke) FetchRemoteCRLContext(ctx context.Context, url string, issuer *x509.Certificate, force bool) error {
 	shouldFetchCRL := !r.isInMemoryCRLValid(url)
 
 	if force || shouldFetchCRL {
-		crl, err := fetchCRL(url)
+		crl, err := fetchCRL(ctx, url)
 		if err != nil {
 			return fmt.Errorf("failed to fetch CRL: %v", err)
 		}
 
 		// check CRL signature
 		if issuer != nil {
-			err = issuer.CheckCRLSignature(crl)
+			err = crl.CheckSignatureFrom(issuer)
 			if err != nil {
 				return fmt.Errorf("failed to verify CRL: %v", err)
 			}
 		}
 
-		r.lock.Lock()
-		r.crlSet[url] = crl
-		r.lock.Unlock()
+		if !r.acceptCRLNumber(url, crl) {
+			return fmt.Errorf("rejected CRL from %s: CRL number is not higher than the cached CRL", url)
+		}
+
+		r.getCache().Add(url, crl)
+		r.remoteCRLIssuers.set(url, issuer)
 	}
 
 	return nil
 }
 
-// check a cert against a specific CRL. Returns the same bool pair
-// as revCheck. If remote is false - will assume that url is a file.
-func (r *Revoke) certIsRevokedCRL(cert *x509.Certificate, crlPath string, remote bool) (revoked, ok bool) {
+// SetRefreshSkew sets how far ahead of a remote CRL's NextUpdate
+// StartRefresher re-fetches it. A non-positive d falls back to
+// defaultRefreshSkew.
+func (r *Revoke) SetRefreshSkew(d time.Duration) {
+	if d <= 0 {
+		d = defaultRefreshSkew
+	}
+	r.lock.Lock()
+	r.refreshSkew = d
+	r.lock.Unlock()
+}
+
+// refreshRemoteCRLs re-fetches every remote CRL r has previously
+// fetched whose cached copy is within skew of expiring (or already
+// missing from the cache), honoring ctx's deadline and cancellation.
+func (r *Revoke) refreshRemoteCRLs(ctx context.Context, skew time.Duration) {
+	for _, url := range r.remoteCRLIssuers.keys() {
+		issuer, ok := r.remoteCRLIssuers.get(url)
+		if !ok {
+			continue
+		}
+
+		crl, ok := r.getCache().Get(url)
+		needsRefresh := !ok || crl == nil
+		if !needsRefresh && !crl.NextUpdate.IsZero() {
+			needsRefresh = time.Now().Add(skew).After(crl.NextUpdate)
+		}
+		if !needsRefresh {
+			continue
+		}
+
+		if err := r.FetchRemoteCRLContext(ctx, url, issuer, true); err != nil {
+			log.Warningf("failed to refresh remote CRL %s: %v", url, err)
+		}
+	}
+}
+
+// StartRefresher starts a background goroutine that, every interval,
+// re-scans r's local CRL directory (see SetLocalCRL) for changed
+// files and re-fetches any remote CRL that's within r's refresh skew
+// of expiring. It returns a stop function that halts the goroutine;
+// stop may be called more than once.
+func (r *Revoke) StartRefresher(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.refreshLocalCRLDir()
+
+				r.lock.Lock()
+				skew := r.refreshSkew
+				r.lock.Unlock()
+				r.refreshRemoteCRLs(context.Background(), skew)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// acceptCRLNumber reports whether crl's CRL Number extension (RFC
+// 5280 §5.2.3), if any, is higher than the last one seen for key,
+// updating the high-water mark when it is. This provides rollback
+// protection: an attacker who replays an older, stale CRL can't use
+// it to un-revoke a certificate. A CRL without a CRL Number extension
+// is always accepted.
+//
+// r.crlNumbers only remembers numbers seen since this *Revoke was
+// constructed, so a process that restarts with a disk-backed
+// FileCache (see SetCache) would otherwise lose rollback protection
+// on every restart even though the cache itself still holds the last
+// CRL it fetched. To close that gap, the first time key is seen this
+// also falls back to whatever CRL is already sitting in the cache
+// (warmed from disk or otherwise) and treats its Number as the floor.
+func (r *Revoke) acceptCRLNumber(key string, crl *x509.RevocationList) bool {
+	number := crl.Number
+	if number == nil {
+		return true
+	}
+
+	r.lock.Lock()
+	prev, ok := r.crlNumbers[key]
+	r.lock.Unlock()
+
+	if !ok {
+		if cached, found := r.getCache().Get(key); found && cached.Number != nil {
+			prev, ok = cached.Number, true
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if latest, found := r.crlNumbers[key]; found && (!ok || latest.Cmp(prev) > 0) {
+		prev, ok = latest, true
+	}
+	if ok && number.Cmp(prev) <= 0 {
+		return false
+	}
+	r.crlNumbers[key] = number
+	return true
+}
+
+// applyDeltaCRL follows base's Freshest CRL extension (RFC 5280
+// §5.2.6), if present, fetching and merging in the first delta CRL
+// whose Delta CRL Indicator references base's CRL Number. If no
+// usable delta CRL is found, base is returned unchanged. The delta is
+// fetched through r.FetchRemoteCRLContext, under its own URL as cache
+// key, so it benefits from the same caching and CRL-number rollback
+// protection as any other remote CRL instead of being re-fetched over
+// the network on every single certificate check.
+func (r *Revoke) applyDeltaCRL(ctx context.Context, base *x509.RevocationList, issuer *x509.Certificate) *x509.RevocationList {
+	urls, err := freshestCRLURLs(base)
+	if err != nil {
+		log.Warningf("failed to parse freshest CRL extension: %v", err)
+		return base
+	}
+	if len(urls) == 0 {
+		return base
+	}
+
+	baseNumber := base.Number
+
+	for _, url := range urls {
+		if ldapURL(url) {
+			continue
+		}
+
+		if err := r.FetchRemoteCRLContext(ctx, url, issuer, false); err != nil {
+			log.Warningf("failed to fetch delta CRL %s: %v", url, err)
+			continue
+		}
+
+		delta, ok := r.getCache().Get(url)
+		if !ok {
+			log.Warningf("delta CRL for %s not found in cache after fetch", url)
+			continue
+		}
+
+		deltaBase, err := deltaBaseCRLNumber(delta)
+		if err != nil {
+			log.Warningf("%v", err)
+			continue
+		}
+		if deltaBase == nil || baseNumber == nil || deltaBase.Cmp(baseNumber) != 0 {
+			log.Warningf("delta CRL %s does not apply to the cached base CRL", url)
+			continue
+		}
+
+		return mergeDelta(base, delta)
+	}
+
+	return base
+}
+
+// check a cert against a specific CRL. Returns the same bool pair as
+// revCheck. If remote is false, crlPath is read from the local
+// filesystem and no CRL signature check is performed; otherwise it's
+// fetched from crlPath over the network and, if issuer is non-nil,
+// verified against it.
+func (r *Revoke) certIsRevokedCRL(ctx context.Context, cert *x509.Certificate, crlPath string, remote bool, issuer *x509.Certificate) (revoked, ok bool) {
 	var err error
 	if remote {
-		err = r.FetchRemoteCRL(crlPath, getIssuer(cert), false)
+		err = r.FetchRemoteCRLContext(ctx, crlPath, issuer, false)
 	} else {
 		err = r.fetchLocalCRL(crlPath, false)
 	}
@@ -308,9 +1020,24 @@ func (r *Revoke) certIsRevokedCRL(cert *x509.Certificate, crlPath string, remote
 		return false, false
 	}
 
-	defer r.lock.Unlock()
-	r.lock.Lock()
-	for _, revoked := range r.crlSet[crlPath].TBSCertList.RevokedCertificates {
+	crl, ok := r.getCache().Get(crlPath)
+	if !ok {
+		log.Warningf("CRL for %s not found in cache after fetch", crlPath)
+		return false, false
+	}
+
+	idpURL := ""
+	if remote {
+		idpURL = crlPath
+	}
+	if err := checkIssuingDistributionPoint(crl, idpURL, cert); err != nil {
+		log.Warningf("CRL from %s is not usable for this certificate: %v", crlPath, err)
+		return false, false
+	}
+
+	crl = r.applyDeltaCRL(ctx, crl, issuer)
+
+	for _, revoked := range crl.RevokedCertificateEntries {
 		if cert.SerialNumber.Cmp(revoked.SerialNumber) == 0 {
 			log.Info("Serial number match: intermediate is revoked.")
 			return true, true
@@ -339,24 +1066,47 @@ func VerifyCertificate(cert *x509.Certificate) (revoked, ok bool) {
 	return defaultChecker.VerifyCertificate(cert)
 }
 
+// VerifyCertificateContext ensures that the certificate passed in
+// hasn't expired and checks the CRL for the server, bounding any
+// network access by ctx.
+func VerifyCertificateContext(ctx context.Context, cert *x509.Certificate) (revoked, ok bool) {
+	return defaultChecker.VerifyCertificateContext(ctx, cert)
+}
+
 // VerifyCertificate ensures that the certificate passed in hasn't
 // expired and checks the CRL for the server.
 func (r *Revoke) VerifyCertificate(cert *x509.Certificate) (revoked, ok bool) {
+	return r.VerifyCertificateContext(context.Background(), cert)
+}
+
+// VerifyCertificateContext ensures that the certificate passed in
+// hasn't expired and checks the CRL for the server. Callers that embed
+// cfssl in servers (for example to verify peer certs during a TLS
+// handshake) can pass a ctx with a deadline to bound the revocation
+// lookup instead of blocking indefinitely on a stalled CDP/OCSP
+// responder.
+func (r *Revoke) VerifyCertificateContext(ctx context.Context, cert *x509.Certificate) (revoked, ok bool) {
 	if !verifyCertTime(cert) {
 		return true, true
 	}
 
-	return r.revCheck(cert)
+	return r.revCheck(ctx, cert)
 }
 
-func fetchRemote(url string) (*x509.Certificate, error) {
-	resp, err := http.Get(url)
+func fetchRemote(ctx context.Context, url string) (*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	in, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		resp.Body.Close()
 		return nil, err
 	}
 	resp.Body.Close()
@@ -373,75 +1123,94 @@ var ocspOpts = ocsp.RequestOptions{
 	Hash: crypto.SHA1,
 }
 
-func certIsRevokedOCSP(leaf *x509.Certificate, strict bool) (revoked, ok bool) {
-	var err error
-
-	ocspURLs := leaf.OCSPServer
-	if len(ocspURLs) == 0 {
-		// OCSP not enabled for this certificate.
-		return false, true
-	}
-
-	issuer := getIssuer(leaf)
-
+// VerifyStapledOCSP checks cert's revocation status against staple, a
+// DER-encoded OCSP response obtained via TLS stapling (for example
+// tls.ConnectionState.OCSPResponse), without any network round-trip.
+// It returns the same bool pair as VerifyCertificate: ok is false if
+// staple doesn't parse, doesn't cover cert, or isn't signed by issuer.
+func VerifyStapledOCSP(cert, issuer *x509.Certificate, staple []byte) (revoked, ok bool) {
 	if issuer == nil {
 		return false, false
 	}
 
-	ocspRequest, err := ocsp.CreateRequest(leaf, issuer, &ocspOpts)
+	resp, err := ocsp.ParseResponseForCert(staple, cert, issuer)
 	if err != nil {
-		return
+		return false, false
 	}
 
-	for _, server := range ocspURLs {
-		resp, err := sendOCSPRequest(server, ocspRequest, issuer)
-		if err != nil {
-			if strict {
-				return
-			}
-			continue
-		}
-		if err = resp.CheckSignatureFrom(issuer); err != nil {
-			return false, false
-		}
-
-		// There wasn't an error fetching the OCSP status.
-		ok = true
+	switch resp.Status {
+	case ocsp.Good:
+		return false, true
+	case ocsp.Revoked:
+		return true, true
+	default:
+		// ocsp.Unknown (or any other non-definitive status): the
+		// staple doesn't tell us anything conclusive.
+		return false, false
+	}
+}
 
-		if resp.Status != ocsp.Good {
-			// The certificate was revoked.
-			revoked = true
-		}
+// checkOCSPResponder queries a single OCSP responder for the status
+// of the certificate ocspRequest was built for, verifying the
+// response against issuer. It's one endpoint among potentially many
+// that runEndpointChecks queries concurrently, so it doesn't try other
+// responders itself on failure.
+func checkOCSPResponder(ctx context.Context, server string, ocspRequest []byte, issuer *x509.Certificate) (revoked, ok bool) {
+	resp, err := sendOCSPRequest(ctx, server, ocspRequest, issuer)
+	if err != nil {
+		return false, false
+	}
+	if err := resp.CheckSignatureFrom(issuer); err != nil {
+		return false, false
+	}
 
-		return
+	switch resp.Status {
+	case ocsp.Good:
+		return false, true
+	case ocsp.Revoked:
+		return true, true
+	default:
+		// ocsp.Unknown (or any other non-definitive status): this
+		// responder can't vouch for the certificate.
+		return false, false
 	}
-	return
 }
 
 // sendOCSPRequest attempts to request an OCSP response from the
 // server. The error only indicates a failure to *fetch* the
-// certificate, and *does not* mean the certificate is valid.
-func sendOCSPRequest(server string, req []byte, issuer *x509.Certificate) (*ocsp.Response, error) {
-	var resp *http.Response
+// certificate, and *does not* mean the certificate is valid. It
+// honors ctx's deadline and cancellation for the underlying HTTP
+// request.
+func sendOCSPRequest(ctx context.Context, server string, req []byte, issuer *x509.Certificate) (*ocsp.Response, error) {
+	var httpReq *http.Request
 	var err error
 	if len(req) > 256 {
-		buf := bytes.NewBuffer(req)
-		resp, err = http.Post(server, "application/ocsp-request", buf)
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(req))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/ocsp-request")
 	} else {
 		reqURL := server + "/" + base64.StdEncoding.EncodeToString(req)
-		resp, err = http.Get(reqURL)
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	resp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		return nil, fmt.Errorf("failed to retrieve OSCP")
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		resp.Body.Close()
 		return nil, err
 	}
 	resp.Body.Close()
@@ -0,0 +1,225 @@
+package revoke
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// freshestCRLExtension builds a pkix.Extension carrying an RFC 5280
+// §5.2.6 Freshest CRL extension pointing at the given delta CRL
+// distribution point URLs.
+func freshestCRLExtension(t *testing.T, urls []string) pkix.Extension {
+	t.Helper()
+
+	var fullName []asn1.RawValue
+	for _, url := range urls {
+		fullName = append(fullName, asn1.RawValue{
+			Class: asn1.ClassContextSpecific,
+			Tag:   6,
+			Bytes: []byte(url),
+		})
+	}
+	points := []distributionPoint{{DistributionPoint: distributionPointName{FullName: fullName}}}
+
+	der, err := asn1.Marshal(points)
+	if err != nil {
+		t.Fatalf("failed to marshal test freshest CRL extension: %v", err)
+	}
+	return pkix.Extension{Id: oidExtensionFreshestCRL, Value: der}
+}
+
+// deltaCRLIndicatorExtension builds a pkix.Extension carrying an RFC
+// 5280 §5.2.4 Delta CRL Indicator referencing baseNumber.
+func deltaCRLIndicatorExtension(t *testing.T, baseNumber int64) pkix.Extension {
+	t.Helper()
+
+	der, err := asn1.Marshal(big.NewInt(baseNumber))
+	if err != nil {
+		t.Fatalf("failed to marshal test delta CRL indicator extension: %v", err)
+	}
+	return pkix.Extension{Id: oidExtensionDeltaCRLIndicator, Value: der}
+}
+
+func TestAcceptCRLNumber(t *testing.T) {
+	r := New(false)
+
+	if !r.acceptCRLNumber("key", &x509.RevocationList{Number: big.NewInt(5)}) {
+		t.Fatal("expected the first CRL number seen for a key to be accepted")
+	}
+	if r.acceptCRLNumber("key", &x509.RevocationList{Number: big.NewInt(3)}) {
+		t.Fatal("expected a lower (rolled-back) CRL number to be rejected")
+	}
+	if !r.acceptCRLNumber("key", &x509.RevocationList{Number: big.NewInt(10)}) {
+		t.Fatal("expected a higher CRL number to be accepted")
+	}
+	if r.acceptCRLNumber("key", &x509.RevocationList{Number: big.NewInt(10)}) {
+		t.Fatal("expected a replayed, equal CRL number to be rejected")
+	}
+	if !r.acceptCRLNumber("key", &x509.RevocationList{}) {
+		t.Fatal("expected a CRL without a Number extension to always be accepted")
+	}
+}
+
+// TestAcceptCRLNumber_SeedsFromWarmedCache simulates a process
+// restart with a disk-backed FileCache: a fresh *Revoke has an empty
+// crlNumbers map, but the cache it was handed already holds the last
+// CRL fetched before the restart. A replayed, stale CRL for the same
+// key must still be rejected.
+func TestAcceptCRLNumber_SeedsFromWarmedCache(t *testing.T) {
+	r := New(false)
+	cache := NewLRUCache(0)
+	cache.Add("key", &x509.RevocationList{Number: big.NewInt(10)})
+	r.SetCache(cache)
+
+	if r.acceptCRLNumber("key", &x509.RevocationList{Number: big.NewInt(5)}) {
+		t.Fatal("expected a CRL number lower than the one already cached (from before a restart) to be rejected")
+	}
+	if !r.acceptCRLNumber("key", &x509.RevocationList{Number: big.NewInt(11)}) {
+		t.Fatal("expected a CRL number higher than the one already cached to be accepted")
+	}
+	if r.acceptCRLNumber("key", &x509.RevocationList{Number: big.NewInt(11)}) {
+		t.Fatal("expected a replayed, equal CRL number to be rejected")
+	}
+}
+
+// TestApplyDeltaCRL_CachesDeltaFetch confirms a delta CRL is fetched
+// at most once across repeated applyDeltaCRL calls for the same base
+// CRL, instead of hitting the delta distribution point on every
+// single certificate check.
+func TestApplyDeltaCRL_CachesDeltaFetch(t *testing.T) {
+	issuer, key := newTestIssuer(t)
+
+	var hits int32
+	var deltaDER []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write(deltaDER)
+	}))
+	defer server.Close()
+
+	delta := newTestCRL(t, issuer, key, 1, nil, []pkix.Extension{deltaCRLIndicatorExtension(t, 1)})
+	deltaDER = delta.Raw
+
+	base := newTestCRL(t, issuer, key, 1, nil, []pkix.Extension{freshestCRLExtension(t, []string{server.URL})})
+
+	r := New(false)
+	for i := 0; i < 3; i++ {
+		merged := r.applyDeltaCRL(context.Background(), base, issuer)
+		if merged == base {
+			t.Fatalf("call %d: expected the delta CRL to be applied", i)
+		}
+	}
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("expected the delta CRL endpoint to be hit once and then served from cache, got %d hits", got)
+	}
+}
+
+func TestRunEndpointChecks_AllMustAgreeWaitsForSlowerRevoked(t *testing.T) {
+	r := New(false) // defaults to PolicyAllMustAgree
+
+	checks := []endpointCheck{
+		{
+			label: "fast-good",
+			run: func(ctx context.Context) (revoked, ok bool) {
+				return false, true
+			},
+		},
+		{
+			label: "slow-revoked",
+			run: func(ctx context.Context) (revoked, ok bool) {
+				time.Sleep(50 * time.Millisecond)
+				return true, true
+			},
+		},
+	}
+
+	revoked, ok := r.runEndpointChecks(context.Background(), checks)
+	if !ok || !revoked {
+		t.Fatalf("expected a slower \"revoked\" endpoint to win under the default PolicyAllMustAgree, got revoked=%v ok=%v", revoked, ok)
+	}
+}
+
+func TestRunEndpointChecks_AnyGoodShortCircuitsWhenOptedIn(t *testing.T) {
+	r := New(false)
+	r.SetPolicy(PolicyAnyGood)
+
+	checks := []endpointCheck{
+		{
+			label: "fast-good",
+			run: func(ctx context.Context) (revoked, ok bool) {
+				return false, true
+			},
+		},
+		{
+			label: "slow-revoked",
+			run: func(ctx context.Context) (revoked, ok bool) {
+				time.Sleep(50 * time.Millisecond)
+				return true, true
+			},
+		},
+	}
+
+	revoked, ok := r.runEndpointChecks(context.Background(), checks)
+	if !ok || revoked {
+		t.Fatalf("expected the faster \"not revoked\" endpoint to win under opt-in PolicyAnyGood, got revoked=%v ok=%v", revoked, ok)
+	}
+}
+
+func TestRunEndpointChecks_AllMustAgreeFailsOnUnreachableEndpoint(t *testing.T) {
+	r := New(false)
+
+	checks := []endpointCheck{
+		{
+			label: "good",
+			run: func(ctx context.Context) (revoked, ok bool) {
+				return false, true
+			},
+		},
+		{
+			label: "unreachable",
+			run: func(ctx context.Context) (revoked, ok bool) {
+				return false, false
+			},
+		},
+	}
+
+	revoked, ok := r.runEndpointChecks(context.Background(), checks)
+	if ok || revoked {
+		t.Fatalf("expected an unreachable endpoint to fail the check under PolicyAllMustAgree, got revoked=%v ok=%v", revoked, ok)
+	}
+}
+
+func TestRunEndpointChecks_OCSPFallbackToCRLToleratesUnreachableEndpoint(t *testing.T) {
+	r := New(false)
+	r.OCSPFallbackToCRL = true
+
+	checks := []endpointCheck{
+		{
+			label: "good",
+			run: func(ctx context.Context) (revoked, ok bool) {
+				return false, true
+			},
+		},
+		{
+			label: "unreachable",
+			ocsp:  true,
+			run: func(ctx context.Context) (revoked, ok bool) {
+				return false, false
+			},
+		},
+	}
+
+	revoked, ok := r.runEndpointChecks(context.Background(), checks)
+	if !ok || revoked {
+		t.Fatalf("expected OCSPFallbackToCRL to tolerate an unreachable endpoint under PolicyAllMustAgree, got revoked=%v ok=%v", revoked, ok)
+	}
+}